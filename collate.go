@@ -1,32 +1,74 @@
 package collate
 
 import (
-	//"fmt"
+	"container/heap"
+	"encoding/csv"
+	"fmt"
 	"github.com/guitarvydas/ip"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
 func Collate(name string, ctl <-chan string, in []chan ip.IP, out chan<- ip.IP) {
-	fieldLengths, nFields := makeFieldArray(<-ctl)
+	CollateWithOptions(name, ctl, in, out, Options{})
+}
+
+// Options configures an optional pre-merge filtering layer for
+// CollateWithOptions. Filters has one entry per input port; a nil entry
+// (or a nil Filters slice) means that port is passed through unfiltered.
+//
+// Extractor, if set, is used instead of the KeyExtractor CollateWithOptions
+// would otherwise parse from the control string. Pass the same
+// KeyExtractor instance here and to a FieldEqualsFilter in Filters so the
+// two are guaranteed to agree on field indices, rather than the caller
+// hand-building a second extractor and keeping it in sync by inspection.
+// Its NumFields() must still agree with the control string's declared
+// field count — CollateWithOptions panics on construction if it doesn't,
+// since the two are otherwise built independently and have no other way
+// to be kept in sync.
+type Options struct {
+	Filters   []Filter
+	Extractor KeyExtractor
+}
+
+// CollateWithOptions behaves like Collate, except that each input port's
+// records are run through its corresponding Filter (if any) before
+// taking part in the merge. Filtering only ever drops records, so it
+// cannot break the "each input is already sorted" invariant the merge
+// relies on; a port whose stream is filtered down to nothing still EOFs
+// normally and nActive is decremented exactly as without filtering.
+func CollateWithOptions(name string, ctl <-chan string, in []chan ip.IP, out chan<- ip.IP, opts Options) {
+	extractor, fieldSpecs := parseControl(<-ctl)
+	if opts.Extractor != nil {
+		if n := opts.Extractor.NumFields(); n != len(fieldSpecs) {
+			panic(fmt.Sprintf("collate: Options.Extractor has %d fields but the control string declares %d", n, len(fieldSpecs)))
+		}
+		extractor = opts.Extractor
+	}
+	nFields := len(fieldSpecs)
+	collators := makeCollators(fieldSpecs)
 
-	// Also, the record "keys" are characters in fields at the front of the record.  Calculate
-	// the maximum key size so we can trim before comparing.
-	// For example a master record might look like
+	// The record "keys" are extracted from the front of each record by
+	// extractor: FixedWidthExtractor slices fixed byte ranges (the
+	// original "3,2,5" style control string), DelimitedExtractor picks
+	// the Nth delimited/CSV field instead. For example a fixed-width
+	// master record might look like
 	//
 	// 111AA11111   M
 	//
-	// With 3 keys, the leftmost is 3 chars, then 2 chars then 5 chars
-	// the data starts in the 11th column (we need to strip the data when
-	// comparing keys).  In this example, keylen should be calculated to
-	// be 3+2+5 = 10
-	// Keys sort in ASCII order, e.g. "111" is less than "222", etc.
+	// With 3 keys, the leftmost is 3 chars, then 2 chars then 5 chars;
+	// the data starts in the 11th column. Keys sort in plain byte order
+	// (e.g. "111" is less than "222") unless a field asks for locale
+	// collation with lang=, ci or cs, or for numeric ordering.
 	//
-	// Each key is nested by open/close brackets.  In the example above, there
-	// are three fields in the key, so 3 open brackets are sent out initially.
-	// When the key "level" changes, we close that level and send out a new open.
-	// E.g. The above record, followed by a change to the inner-most field
+	// Each key is nested by open/close brackets. In the example above,
+	// there are three fields in the key, so 3 open brackets are sent out
+	// initially. When the key "level" changes, we close that level and
+	// send out a new open. E.g. the above record, followed by a change
+	// to the inner-most field
 	//
 	// 111AA11111   M
 	// 111AA22222   M
@@ -37,56 +79,41 @@ func Collate(name string, ctl <-chan string, in []chan ip.IP, out chan<- ip.IP)
 	//
 	// i.e. the bracketing is done on a key field level, e.g. a key with
 	// three fields will be at most 3 brackets deep
-	keylen := 0
 	for i := 0; i < nFields; i++ {
 		out <- ip.IP{Kind: ip.Open}
-		keylen += fieldLengths[i]
 	}
 
 	// nActive is used to detect when all input ports are EOF ; go recommends doing this
 	// another way (using a second set of "done" channels), but we'll try this
 	nActive := len(in)
-	nPorts := len(in)
-
-	// create a holding slot for every channel, and read first entry into each
-	// set the initial value of lowestKey and lowestPort
-	highestKey := makeKey(keylen, 255)
-	lowestKey := highestKey // init high
-	lowestKeyFields := sliceKey(lowestKey, fieldLengths)
-	lowestPort := 0
-	parray := make([]ip.IP, len(in))
-	for i := 0; nActive > 0 && i < (len(parray)); i++ {
-		parray[i] = <-in[i]
-		if parray[i].Kind == ip.EOF {
+
+	// ports is an indexed min-heap over the current head IP of every input
+	// port, keyed on that IP's key fields. This makes lowest-key selection
+	// O(log nPorts) instead of an O(nPorts) linear scan, so the collator
+	// scales to large fan-in (hundreds of upstream sorted streams).
+	ports := newPortHeap(fieldSpecs)
+	for i := 0; i < len(in); i++ {
+		rec := readFiltered(in, opts.Filters, i)
+		if rec.Kind == ip.EOF {
 			nActive--
 		} else {
-			key := parray[i].Data[0:keylen]
-			if key < lowestKey {
-				lowestKey = key
-				lowestPort = i
-				lowestKeyFields = sliceKey(lowestKey, fieldLengths)
-			}
+			key := buildKeyFields(extractor.Fields(rec.Data), fieldSpecs, collators)
+			heap.Push(ports, &portEntry{port: i, ip: rec, key: key})
 		}
 	}
 
-	prevKeyFields := lowestKeyFields
+	var prevKeyFields []KeyField
+	if len(ports.entries) > 0 {
+		prevKeyFields = ports.entries[0].key
+	}
 	nClosesNeeded := nFields
 	firstTime := true
 
 	// Collation - search for lowest
 	for nActive > 0 {
-		lowestKey := highestKey
-		lowestPort := 0
-		for i := 0; i < nPorts; i++ {
-			if parray[i].Kind != ip.EOF {
-				key := parray[i].Data[0:keylen]
-				if key < lowestKey {
-					lowestKey = key
-					lowestPort = i
-					lowestKeyFields = sliceKey(lowestKey, fieldLengths)
-				}
-			}
-		}
+		lowest := ports.entries[0]
+		lowestKeyFields := lowest.key
+		lowestPort := lowest.port
 		if firstTime {
 			firstTime = false
 		} else {
@@ -94,12 +121,16 @@ func Collate(name string, ctl <-chan string, in []chan ip.IP, out chan<- ip.IP)
 			prevKeyFields = lowestKeyFields
 		}
 		// send found record
-		out <- parray[lowestPort]
+		out <- lowest.ip
 		// fetch next
-		nextrec := <-in[lowestPort]
-		parray[lowestPort] = nextrec
+		nextrec := readFiltered(in, opts.Filters, lowestPort)
 		if nextrec.Kind == ip.EOF {
+			heap.Remove(ports, ports.position[lowestPort])
 			nActive--
+		} else {
+			lowest.ip = nextrec
+			lowest.key = buildKeyFields(extractor.Fields(nextrec.Data), fieldSpecs, collators)
+			heap.Fix(ports, ports.position[lowestPort])
 		}
 	}
 
@@ -110,43 +141,333 @@ func Collate(name string, ctl <-chan string, in []chan ip.IP, out chan<- ip.IP)
 	out <- ip.IP{Kind: ip.EOF}
 }
 
-func makeFieldArray(s string) ([]int, int) {
-	re := regexp.MustCompile("([0-9]+),?")
-	sa := re.FindAllString(s, -1)
-	a := make([]int, len(sa))
-	for i := 0; i < len(a); i++ {
-		n := strings.Replace(sa[i], ",", "", -1)
-		a[i], _ = strconv.Atoi(n)
+// FieldSpec describes how to compare one key field (extraction is a
+// separate concern, handled by a KeyExtractor). The control-channel
+// grammar attaches these as optional, colon-separated attributes on
+// either a fixed-width list ("3,2,5") or a delimited field-index list
+// ("fields=1,3,5"), e.g.
+//
+//	"3,2,5"                  -- widths only, binary (legacy) comparison
+//	"3:lang=fr,2:ci,5:bin"   -- French locale, case-insensitive, 3rd field binary
+//	"3n,2,5n"                -- 1st and 3rd field numeric ("file2" < "file10")
+//
+// Recognized attributes, applied in any order:
+//
+//	lang=<BCP47>  language tag used to build the field's collator (default "und")
+//	ci            case-insensitive collation
+//	cs            case-sensitive collation (default, once collation is requested)
+//	desc          descending order for this field (default ascending)
+//	bin           raw byte comparison for this field (the default unless
+//	              lang=/ci/cs requests collation; always wins over them)
+//	num (or a trailing "n" right after the width) numeric-aware ordering
+type FieldSpec struct {
+	Width      int
+	Lang       language.Tag
+	CaseLevel  bool // true => case-insensitive
+	Descending bool
+	Binary     bool
+	Numeric    bool
+}
+
+// KeyField holds the raw (user-visible) text of a key field alongside
+// its precomputed collation key, when it has one. sendBrackets always
+// compares Raw, so bracket level changes track the record the way the
+// user sees it. Lowest-key selection compares CollationKey for collated
+// fields, or Raw itself for Binary and Numeric fields — Numeric fields
+// are compared by numericCompare, recomputed fresh from Raw on every
+// comparison rather than cached, since a cached, padded token would go
+// stale as wider numbers appear on other ports mid-run.
+type KeyField struct {
+	Raw          string
+	CollationKey []byte
+}
+
+// KeyExtractor pulls the raw (uncollated) key fields out of a record's
+// data, in field order. Collate no longer hard-codes byte-offset
+// slicing: FixedWidthExtractor preserves that original behavior, while
+// DelimitedExtractor selects fields by delimiter or CSV position.
+// NumFields reports how many fields Fields returns, so CollateWithOptions
+// can validate a caller-supplied Extractor against the control string's
+// declared field count before using it.
+type KeyExtractor interface {
+	Fields(data string) []string
+	NumFields() int
+}
+
+// FixedWidthExtractor slices data at fixed byte offsets, the
+// original "3,2,5" style control string behavior.
+type FixedWidthExtractor struct {
+	Widths []int
+}
+
+func (e FixedWidthExtractor) Fields(data string) []string {
+	result := make([]string, len(e.Widths))
+	index := 0
+	for i, w := range e.Widths {
+		result[i] = data[index : index+w]
+		index += w
+	}
+	return result
+}
+
+func (e FixedWidthExtractor) NumFields() int { return len(e.Widths) }
+
+// DelimitedExtractor splits data on a delimiter (or parses it as RFC
+// 4180 CSV) and picks the 1-based FieldIndexes as the key fields.
+// Fields() returns the raw, unpadded text of each field: Collate's
+// comparisons are all done field-by-field rather than by concatenating
+// key bytes, so a shorter field already sorts correctly against a longer
+// one without padding, and Raw stays stable across calls (the same
+// user-visible value always produces the same Raw string, which matters
+// since sendBrackets detects level changes by comparing Raw directly).
+type DelimitedExtractor struct {
+	Delim        byte
+	FieldIndexes []int
+	CSV          bool
+}
+
+func (e *DelimitedExtractor) Fields(data string) []string {
+	var raw []string
+	if e.CSV {
+		r := csv.NewReader(strings.NewReader(data))
+		r.Comma = rune(e.Delim)
+		if rec, err := r.Read(); err == nil {
+			raw = rec
+		}
+	}
+	if raw == nil {
+		raw = strings.Split(data, string(e.Delim))
 	}
-	return a, len(a)
+	result := make([]string, len(e.FieldIndexes))
+	for i, idx := range e.FieldIndexes {
+		if idx-1 >= 0 && idx-1 < len(raw) {
+			result[i] = raw[idx-1]
+		}
+	}
+	return result
 }
 
-func makeKey(keylen int, value byte) string { // unicode left as exercise
-	str := make([]byte, keylen)
-	for i := 0; i < len(str); i++ {
-		str[i] = value
+func (e *DelimitedExtractor) NumFields() int { return len(e.FieldIndexes) }
+
+var fixedFieldRE = regexp.MustCompile(`([0-9]+)(n)?((?::[a-zA-Z]+(?:=[^:,]+)?)*),?`)
+
+// parseControl reads the control-channel string and builds the
+// KeyExtractor and per-field comparison attributes it describes. Two
+// grammars are accepted:
+//
+//	"3,2,5[:attrs]..."               -- fixed-width columns (legacy)
+//	"delim=<sep> fields=1,3,5[:attrs]..."   -- delimited/whitespace fields
+//	"csv fields=2,4[:attrs]..."              -- RFC 4180 CSV fields
+func parseControl(s string) (KeyExtractor, []FieldSpec) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "delim=") || strings.HasPrefix(s, "csv") {
+		return parseDelimitedControl(s)
 	}
-	return string(str)
+	specs, _ := makeFieldArray(s)
+	return FixedWidthExtractor{Widths: widths(specs)}, specs
 }
 
-func sliceKey(key string, fieldArray []int) []string {
-	// to make level comparison simpler, chop up the key into
-	// its component fields, returning a slice of fields
-	result := make([]string, len(fieldArray))
-	index := 0
-	for i := 0; i < len(fieldArray); i++ {
-		flen := fieldArray[i]
-		result[i] = key[index : index+flen]
-		index += flen
+func parseDelimitedControl(s string) (KeyExtractor, []FieldSpec) {
+	delim := byte(',')
+	csvMode := false
+	fieldsToken := ""
+	for _, tok := range strings.Fields(s) {
+		switch {
+		case tok == "csv":
+			csvMode = true
+		case strings.HasPrefix(tok, "delim="):
+			if d := unescapeDelim(strings.TrimPrefix(tok, "delim=")); d != 0 {
+				delim = d
+			}
+		case strings.HasPrefix(tok, "fields="):
+			fieldsToken = strings.TrimPrefix(tok, "fields=")
+		}
+	}
+	matches := fixedFieldRE.FindAllStringSubmatch(fieldsToken, -1)
+	indexes := make([]int, len(matches))
+	specs := make([]FieldSpec, len(matches))
+	for i, m := range matches {
+		indexes[i], _ = strconv.Atoi(m[1])
+		spec := parseFieldAttrs(m[3])
+		spec.Numeric = spec.Numeric || m[2] == "n"
+		specs[i] = spec
+	}
+	return &DelimitedExtractor{Delim: delim, FieldIndexes: indexes, CSV: csvMode}, specs
+}
+
+func unescapeDelim(s string) byte {
+	switch s {
+	case "\\t":
+		return '\t'
+	case "\\s":
+		return ' '
+	default:
+		if len(s) > 0 {
+			return s[0]
+		}
+		return 0
+	}
+}
+
+func makeFieldArray(s string) ([]FieldSpec, int) {
+	matches := fixedFieldRE.FindAllStringSubmatch(s, -1)
+	specs := make([]FieldSpec, len(matches))
+	for i, m := range matches {
+		width, _ := strconv.Atoi(m[1])
+		spec := parseFieldAttrs(m[3])
+		spec.Width = width
+		spec.Numeric = spec.Numeric || m[2] == "n"
+		specs[i] = spec
+	}
+	return specs, len(specs)
+}
+
+// parseFieldAttrs parses the colon-separated attribute suffix shared by
+// both the fixed-width and delimited control grammars (e.g. ":lang=fr:ci:desc").
+//
+// Binary defaults to true: a field only switches to locale-aware
+// collation when it explicitly asks for it via lang=, ci, or cs. This
+// keeps the legacy widths/fields-only grammar ("3,2,5") byte-for-byte
+// compatible with its original ordering; "bin" remains valid as an
+// explicit (if redundant) opt-out that always wins over ci/cs/lang=.
+func parseFieldAttrs(attrs string) FieldSpec {
+	spec := FieldSpec{Lang: language.Und}
+	var wantsCollation, explicitBin bool
+	for _, attr := range strings.Split(strings.TrimPrefix(attrs, ":"), ":") {
+		if attr == "" {
+			continue
+		}
+		switch {
+		case attr == "ci":
+			spec.CaseLevel = true
+			wantsCollation = true
+		case attr == "cs":
+			spec.CaseLevel = false
+			wantsCollation = true
+		case attr == "desc":
+			spec.Descending = true
+		case attr == "bin":
+			explicitBin = true
+		case attr == "num":
+			spec.Numeric = true
+		case strings.HasPrefix(attr, "lang="):
+			if tag, err := language.Parse(strings.TrimPrefix(attr, "lang=")); err == nil {
+				spec.Lang = tag
+				wantsCollation = true
+			}
+		}
+	}
+	spec.Binary = !wantsCollation || explicitBin
+	return spec
+}
+
+func widths(specs []FieldSpec) []int {
+	a := make([]int, len(specs))
+	for i, s := range specs {
+		a[i] = s.Width
+	}
+	return a
+}
+
+// makeCollators builds one collate.Collator per field, keyed on the
+// field's language tag and case sensitivity. Binary and Numeric fields
+// get a nil collator since they never need one.
+func makeCollators(specs []FieldSpec) []*collate.Collator {
+	collators := make([]*collate.Collator, len(specs))
+	for i, s := range specs {
+		if s.Binary || s.Numeric {
+			continue
+		}
+		opts := []collate.Option{}
+		if s.CaseLevel {
+			opts = append(opts, collate.IgnoreCase)
+		}
+		collators[i] = collate.New(s.Lang, opts...)
+	}
+	return collators
+}
+
+// buildKeyFields pairs each extractor-supplied raw field with its
+// precomputed collation key (skipped for Binary and Numeric fields,
+// which compare Raw directly).
+func buildKeyFields(raws []string, specs []FieldSpec, collators []*collate.Collator) []KeyField {
+	result := make([]KeyField, len(specs))
+	for i, raw := range raws {
+		field := KeyField{Raw: raw}
+		if !specs[i].Binary && !specs[i].Numeric {
+			var buf collate.Buffer
+			field.CollationKey = append([]byte{}, collators[i].Key(&buf, []byte(raw))...)
+		}
+		result[i] = field
 	}
 	return result
 }
 
-func sendBrackets(prev, curr []string, out chan<- ip.IP) int {
+// lessKeyFields reports whether a sorts before b, field by field:
+// Numeric fields compare Raw via numericCompare, Binary fields compare
+// Raw bytes directly, and all other fields compare CollationKey bytes;
+// a field declared "desc" flips the result of that one comparison.
+func lessKeyFields(a, b []KeyField, specs []FieldSpec) bool {
+	for i := range a {
+		var cmp int
+		switch {
+		case specs[i].Numeric:
+			cmp = numericCompare(a[i].Raw, b[i].Raw)
+		case specs[i].Binary:
+			cmp = strings.Compare(a[i].Raw, b[i].Raw)
+		default:
+			cmp = compareBytes(a[i].CollationKey, b[i].CollationKey)
+		}
+		if specs[i].Descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return false
+}
+
+func compareBytes(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// readFiltered reads the next kept IP from in[port], silently discarding
+// any record its filter rejects. A nil filters slice, or a nil entry at
+// port, means pass-through. EOF is always returned as-is.
+func readFiltered(in []chan ip.IP, filters []Filter, port int) ip.IP {
+	var f Filter
+	if port < len(filters) {
+		f = filters[port]
+	}
+	for {
+		rec := <-in[port]
+		if rec.Kind == ip.EOF || f == nil || f.Keep(rec) {
+			return rec
+		}
+	}
+}
+
+func sendBrackets(prev, curr []KeyField, out chan<- ip.IP) int {
 	// [111 AA 11111] vs [111 AA 22222]
 	// [111 AA 11111] vs [111 BB 11111]
 	depth := 0
-	for depth < len(curr) && prev[depth] == curr[depth] {
+	for depth < len(curr) && prev[depth].Raw == curr[depth].Raw {
 		depth += 1
 	}
 	nbrack := len(prev) - 1 - depth // calculate depth - index where mismatch begins
@@ -158,3 +479,54 @@ func sendBrackets(prev, curr []string, out chan<- ip.IP) int {
 	}
 	return depth
 }
+
+// portEntry is one input port's current head IP together with its
+// already-sliced key fields, so a fresh key comparison never has to
+// re-slice or re-collate a field that hasn't changed.
+type portEntry struct {
+	port int
+	ip   ip.IP
+	key  []KeyField
+}
+
+// portHeap is a container/heap.Interface over the active ports' portEntry
+// values, ordered by key field so the root is always the current
+// lowest-key port. position tracks each port's current index in entries
+// so Collate can heap.Fix/heap.Remove a specific port in O(log n) after
+// it delivers a new IP or reaches EOF.
+type portHeap struct {
+	entries  []*portEntry
+	position map[int]int
+	specs    []FieldSpec
+}
+
+func newPortHeap(specs []FieldSpec) *portHeap {
+	return &portHeap{position: make(map[int]int), specs: specs}
+}
+
+func (h portHeap) Len() int { return len(h.entries) }
+
+func (h portHeap) Less(i, j int) bool {
+	return lessKeyFields(h.entries[i].key, h.entries[j].key, h.specs)
+}
+
+func (h portHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.position[h.entries[i].port] = i
+	h.position[h.entries[j].port] = j
+}
+
+func (h *portHeap) Push(x interface{}) {
+	e := x.(*portEntry)
+	h.position[e.port] = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *portHeap) Pop() interface{} {
+	old := h.entries
+	n := len(old)
+	e := old[n-1]
+	h.entries = old[:n-1]
+	delete(h.position, e.port)
+	return e
+}
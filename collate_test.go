@@ -0,0 +1,246 @@
+package collate
+
+import (
+	"fmt"
+	"github.com/guitarvydas/ip"
+	"regexp"
+	"testing"
+)
+
+// runCollate feeds inputs (one already-sorted slice of Data values per
+// port) through Collate under control string ctl and returns every IP it
+// emits, brackets included.
+func runCollate(ctl string, inputs [][]string) []ip.IP {
+	ctlCh := make(chan string, 1)
+	ctlCh <- ctl
+
+	in := make([]chan ip.IP, len(inputs))
+	for i, recs := range inputs {
+		ch := make(chan ip.IP)
+		in[i] = ch
+		go func(ch chan ip.IP, recs []string) {
+			for _, r := range recs {
+				ch <- ip.IP{Kind: ip.Normal, Data: r}
+			}
+			ch <- ip.IP{Kind: ip.EOF}
+		}(ch, recs)
+	}
+
+	out := make(chan ip.IP)
+	go Collate("test", ctlCh, in, out)
+
+	var got []ip.IP
+	for {
+		ev := <-out
+		got = append(got, ev)
+		if ev.Kind == ip.EOF {
+			return got
+		}
+	}
+}
+
+// records extracts just the Data of non-bracket, non-EOF events, in
+// emitted order.
+func records(evs []ip.IP) []string {
+	var data []string
+	for _, e := range evs {
+		if e.Kind != ip.Open && e.Kind != ip.Close && e.Kind != ip.EOF {
+			data = append(data, e.Data)
+		}
+	}
+	return data
+}
+
+func assertRecordOrder(t *testing.T, evs []ip.IP, want []string) {
+	t.Helper()
+	got := records(evs)
+	if len(got) != len(want) {
+		t.Fatalf("got %d records %v, want %d %v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("record order mismatch at %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestCollateFixedWidthMerge(t *testing.T) {
+	evs := runCollate("3,2,5", [][]string{
+		{"111AA11111   M", "111AA22222   M"},
+		{"111BB11111   N"},
+	})
+	assertRecordOrder(t, evs, []string{"111AA11111   M", "111AA22222   M", "111BB11111   N"})
+}
+
+func TestFixedWidthDefaultsToByteOrder(t *testing.T) {
+	// chunk0-1 regression: a bare, attribute-free control string (the
+	// "3,2,5" legacy grammar) must keep today's raw byte ordering, not
+	// silently switch mixed-case fields to Unicode collation (which
+	// sorts lowercase before uppercase).
+	evs := runCollate("1", [][]string{
+		{"b"},
+		{"A", "a"},
+	})
+	assertRecordOrder(t, evs, []string{"A", "a", "b"})
+}
+
+func TestSendBracketsStableAcrossRaggedDelimitedFields(t *testing.T) {
+	// chunk0-3 regression: "a" read once, then again after "ab" has been
+	// seen on another port, must not get a different Raw the second time,
+	// and so must not trigger a spurious close/open between the two
+	// unchanged "a ..." records.
+	evs := runCollate(`delim=\s fields=1:bin`, [][]string{
+		{"a X1", "a X2"},
+		{"ab Y"},
+	})
+	assertRecordOrder(t, evs, []string{"a X1", "a X2", "ab Y"})
+
+	var i int
+	for idx, e := range evs {
+		if e.Data == "a X1" {
+			i = idx
+			break
+		}
+	}
+	if evs[i+1].Data != "a X2" {
+		t.Fatalf("expected \"a X2\" to immediately follow \"a X1\" with no bracket change, got %+v", evs[i:i+3])
+	}
+}
+
+func TestDelimitedCSVQuotedField(t *testing.T) {
+	// chunk0-3: csv fields=... must parse RFC 4180 quoting, so a comma
+	// embedded in a quoted field is not mistaken for a field separator.
+	evs := runCollate(`csv fields=1`, [][]string{
+		{`"banana, yellow",2`},
+		{`"apple, red",1`},
+	})
+	assertRecordOrder(t, evs, []string{`"apple, red",1`, `"banana, yellow",2`})
+}
+
+func TestFixedWidthDescendingOrder(t *testing.T) {
+	// chunk0-3: the "desc" attribute must reverse this field's ordering.
+	evs := runCollate("3:desc", [][]string{
+		{"111"},
+		{"333", "222"},
+	})
+	assertRecordOrder(t, evs, []string{"333", "222", "111"})
+}
+
+func TestNumericOrderingAcrossPorts(t *testing.T) {
+	// chunk0-5 regression: a wider number arriving on one port must not
+	// corrupt the comparison for a narrower number still queued elsewhere.
+	evs := runCollate(`delim=\s fields=1:num`, [][]string{
+		{"99 ninety-nine"},
+		{"7 seven", "100 one-hundred"},
+	})
+	assertRecordOrder(t, evs, []string{"7 seven", "99 ninety-nine", "100 one-hundred"})
+}
+
+func TestNumericOrderingMixedAlphanumeric(t *testing.T) {
+	evs := runCollate(`delim=\s fields=1:num`, [][]string{
+		{"file10 b"},
+		{"file2 a"},
+	})
+	assertRecordOrder(t, evs, []string{"file2 a", "file10 b"})
+}
+
+func TestNumericOrderingSigned(t *testing.T) {
+	evs := runCollate(`delim=\s fields=1:num`, [][]string{
+		{"-5 a"},
+		{"-20 b", "3 c"},
+	})
+	assertRecordOrder(t, evs, []string{"-20 b", "-5 a", "3 c"})
+}
+
+func TestGrepFilter(t *testing.T) {
+	ctlCh := make(chan string, 1)
+	ctlCh <- "3,2,5"
+	in := []chan ip.IP{make(chan ip.IP)}
+	go func() {
+		for _, r := range []string{"111AA11111 keep", "222BB22222 skip"} {
+			in[0] <- ip.IP{Kind: ip.Normal, Data: r}
+		}
+		in[0] <- ip.IP{Kind: ip.EOF}
+	}()
+	out := make(chan ip.IP)
+	go CollateWithOptions("test", ctlCh, in, out, Options{
+		Filters: []Filter{GrepFilter{Include: regexp.MustCompile(`keep`)}},
+	})
+	var got []ip.IP
+	for {
+		ev := <-out
+		got = append(got, ev)
+		if ev.Kind == ip.EOF {
+			break
+		}
+	}
+	assertRecordOrder(t, got, []string{"111AA11111 keep"})
+}
+
+func TestFieldEqualsFilterWithSharedExtractor(t *testing.T) {
+	extractor := &DelimitedExtractor{Delim: ' ', FieldIndexes: []int{1}}
+	ctlCh := make(chan string, 1)
+	ctlCh <- `delim=\s fields=1`
+	in := []chan ip.IP{make(chan ip.IP)}
+	go func() {
+		for _, r := range []string{"a keep", "b skip"} {
+			in[0] <- ip.IP{Kind: ip.Normal, Data: r}
+		}
+		in[0] <- ip.IP{Kind: ip.EOF}
+	}()
+	out := make(chan ip.IP)
+	go CollateWithOptions("test", ctlCh, in, out, Options{
+		Extractor: extractor,
+		Filters:   []Filter{FieldEqualsFilter{Extractor: extractor, Index: 0, Value: "a"}},
+	})
+	var got []ip.IP
+	for {
+		ev := <-out
+		got = append(got, ev)
+		if ev.Kind == ip.EOF {
+			break
+		}
+	}
+	assertRecordOrder(t, got, []string{"a keep"})
+}
+
+func TestCollateWithOptionsRejectsMismatchedExtractor(t *testing.T) {
+	// chunk0-4 regression: an Options.Extractor whose field count
+	// disagrees with the control string's declared field count must fail
+	// clearly, not panic deep inside buildKeyFields with an opaque
+	// index-out-of-range.
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("expected a panic for a mismatched Options.Extractor, got none")
+		}
+		msg := fmt.Sprintf("%v", r)
+		if !regexp.MustCompile(`Extractor has 2 fields but the control string declares 1`).MatchString(msg) {
+			t.Fatalf("panic message %q did not clearly explain the field-count mismatch", msg)
+		}
+	}()
+
+	extractor := &DelimitedExtractor{Delim: ' ', FieldIndexes: []int{1, 2}}
+	ctlCh := make(chan string, 1)
+	ctlCh <- `delim=\s fields=1`
+	in := []chan ip.IP{make(chan ip.IP)}
+	out := make(chan ip.IP)
+	CollateWithOptions("test", ctlCh, in, out, Options{Extractor: extractor})
+}
+
+func BenchmarkCollate(b *testing.B) {
+	for _, nPorts := range []int{2, 16, 128, 1024} {
+		b.Run(fmt.Sprintf("ports=%d", nPorts), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				inputs := make([][]string, nPorts)
+				for p := range inputs {
+					inputs[p] = []string{fmt.Sprintf("%05dAA11111   M", p)}
+				}
+				evs := runCollate("3,2,5", inputs)
+				if len(records(evs)) != nPorts {
+					b.Fatalf("expected %d records, got %d", nPorts, len(records(evs)))
+				}
+			}
+		})
+	}
+}
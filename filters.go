@@ -0,0 +1,72 @@
+package collate
+
+import (
+	"github.com/guitarvydas/ip"
+	"math/rand"
+	"regexp"
+)
+
+// Filter decides whether a record should take part in the merge.
+// CollateWithOptions runs each input port's records through its Filter
+// (if any) before the record is considered for lowest-key selection, so
+// a filtered-out record is simply skipped rather than emitted.
+type Filter interface {
+	Keep(rec ip.IP) bool
+}
+
+// GrepFilter keeps records by regex inclusion/exclusion, mirroring
+// topfew's -g/--grep. Either pattern may be nil to skip that check; both
+// may be set to compose an include-and-exclude filter.
+type GrepFilter struct {
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+}
+
+func (f GrepFilter) Keep(rec ip.IP) bool {
+	if f.Include != nil && !f.Include.MatchString(rec.Data) {
+		return false
+	}
+	if f.Exclude != nil && f.Exclude.MatchString(rec.Data) {
+		return false
+	}
+	return true
+}
+
+// FieldEqualsFilter keeps only records whose key field at Index (as
+// produced by Extractor) equals Value. For Index to line up with the
+// field order a control string declares, pass the same KeyExtractor
+// instance as both Options.Extractor and here — CollateWithOptions
+// otherwise parses its own extractor from the control string, which a
+// hand-built second instance has no way to stay in sync with.
+type FieldEqualsFilter struct {
+	Extractor KeyExtractor
+	Index     int
+	Value     string
+}
+
+func (f FieldEqualsFilter) Keep(rec ip.IP) bool {
+	fields := f.Extractor.Fields(rec.Data)
+	if f.Index < 0 || f.Index >= len(fields) {
+		return false
+	}
+	return fields[f.Index] == f.Value
+}
+
+// SampleFilter keeps a stochastic N-of-M sample of records, mirroring
+// topfew's --sample. Each record is independently kept with probability
+// N/M.
+type SampleFilter struct {
+	N, M int
+	rng  *rand.Rand
+}
+
+func NewSampleFilter(n, m int, seed int64) *SampleFilter {
+	return &SampleFilter{N: n, M: m, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (f *SampleFilter) Keep(rec ip.IP) bool {
+	if f.M <= 0 {
+		return true
+	}
+	return f.rng.Intn(f.M) < f.N
+}
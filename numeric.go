@@ -0,0 +1,109 @@
+package collate
+
+import (
+	"regexp"
+	"strings"
+)
+
+var numericChunkRE = regexp.MustCompile(`-?[0-9]+|[^0-9]+`)
+
+// numericCompare compares two raw field values chunk-wise: a and b are
+// each split into alternating digit/non-digit runs (so mixed
+// alphanumeric values such as "file2" vs "file10" compare correctly),
+// and corresponding digit runs are compared by numeric magnitude rather
+// than lexically, so "9" sorts before "10". A leading "-" on a digit run
+// marks it negative.
+//
+// Unlike a cached, padded comparison token, this recomputes straight
+// from the raw strings on every call, so there is no shared state that
+// can go stale as wider numbers show up on other ports mid-run — the
+// comparison between any two values is always correct on its own terms.
+func numericCompare(a, b string) int {
+	ca := numericChunkRE.FindAllString(a, -1)
+	cb := numericChunkRE.FindAllString(b, -1)
+	for i := 0; i < len(ca) || i < len(cb); i++ {
+		var x, y string
+		if i < len(ca) {
+			x = ca[i]
+		}
+		if i < len(cb) {
+			y = cb[i]
+		}
+		if cmp := compareChunk(x, y); cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+func compareChunk(x, y string) int {
+	xNeg, xDigits, xOK := parseNumericChunk(x)
+	yNeg, yDigits, yOK := parseNumericChunk(y)
+	if xOK && yOK {
+		return compareMagnitude(xDigits, xNeg, yDigits, yNeg)
+	}
+	return strings.Compare(x, y)
+}
+
+// parseNumericChunk reports whether s is a (possibly signed) run of
+// digits, returning its sign and unsigned digit text.
+func parseNumericChunk(s string) (negative bool, digits string, ok bool) {
+	if s == "" {
+		return false, "", false
+	}
+	negative = s[0] == '-'
+	digits = s
+	if negative {
+		digits = s[1:]
+	}
+	if digits == "" {
+		return false, "", false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false, "", false
+		}
+	}
+	return negative, digits, true
+}
+
+// compareMagnitude compares two signed digit runs by numeric value,
+// ignoring leading zeros, without ever parsing them into a machine int
+// (so arbitrarily long digit runs are compared correctly).
+func compareMagnitude(aDigits string, aNeg bool, bDigits string, bNeg bool) int {
+	aDigits = stripLeadingZeros(aDigits)
+	bDigits = stripLeadingZeros(bDigits)
+	aNeg = aNeg && aDigits != "0"
+	bNeg = bNeg && bDigits != "0"
+
+	if aNeg != bNeg {
+		if aNeg {
+			return -1
+		}
+		return 1
+	}
+
+	var cmp int
+	switch {
+	case len(aDigits) != len(bDigits):
+		if len(aDigits) < len(bDigits) {
+			cmp = -1
+		} else {
+			cmp = 1
+		}
+	default:
+		cmp = strings.Compare(aDigits, bDigits)
+	}
+	if aNeg {
+		cmp = -cmp
+	}
+	return cmp
+}
+
+func stripLeadingZeros(digits string) string {
+	trimmed := strings.TrimLeft(digits, "0")
+	if trimmed == "" {
+		return "0"
+	}
+	return trimmed
+}